@@ -0,0 +1,152 @@
+// Package cache provides a sharded, LRU-evicting cache of packed DNS
+// responses, meant to sit in front of xip.QueryResponse so that repeat
+// queries skip the regex matching and dnsmessage.Builder work of
+// re-deriving an answer that hasn't changed.
+package cache
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shardCount is the number of independent shards the cache is split into;
+// each shard has its own lock, so readers and writers hashing to different
+// shards never contend with one another.
+const shardCount = 32
+
+// Key identifies a cached answer: the query name (expected to already be
+// lowercased by the caller), type, and class.
+type Key struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+}
+
+type entry struct {
+	key       Key
+	response  []byte
+	expiresAt time.Time
+	listElem  *list.Element
+}
+
+type shard struct {
+	mu      sync.Mutex
+	entries map[Key]*entry
+	lru     *list.List
+}
+
+// Cache is a sharded cache of packed DNS responses, safe for concurrent use
+// by multiple readers and writers.
+type Cache struct {
+	shards      [shardCount]*shard
+	maxPerShard int
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// New returns a Cache whose shards each hold at most maxEntries/shardCount
+// responses (at least one); when a Set overfills a shard, that shard evicts
+// its least-recently-used entry, whatever the other shards hold.
+func New(maxEntries int) *Cache {
+	c := &Cache{maxPerShard: maxEntries / shardCount}
+	if c.maxPerShard < 1 {
+		c.maxPerShard = 1
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			entries: make(map[Key]*entry),
+			lru:     list.New(),
+		}
+	}
+	return c
+}
+
+func (c *Cache) shardFor(key Key) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key.Name))
+	var buf [4]byte
+	binary.BigEndian.PutUint16(buf[0:2], key.Qtype)
+	binary.BigEndian.PutUint16(buf[2:4], key.Qclass)
+	_, _ = h.Write(buf[:])
+	return c.shards[h.Sum32()%shardCount]
+}
+
+// Get returns the cached response for key, and whether it was found and
+// hadn't yet expired. The returned slice is a copy; callers are free to
+// mutate it (e.g. to rewrite the transaction ID).
+func (c *Cache) Get(key Key) (response []byte, ok bool) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, found := s.entries[key]
+	if !found {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	if time.Now().After(e.expiresAt) {
+		s.evict(e)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	s.lru.MoveToFront(e.listElem)
+	atomic.AddUint64(&c.hits, 1)
+	response = make([]byte, len(e.response))
+	copy(response, e.response)
+	return response, true
+}
+
+// Set stores response under key until expiresAt.
+func (c *Cache) Set(key Key, response []byte, expiresAt time.Time) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, found := s.entries[key]; found {
+		e.response = response
+		e.expiresAt = expiresAt
+		s.lru.MoveToFront(e.listElem)
+		return
+	}
+
+	e := &entry{key: key, response: response, expiresAt: expiresAt}
+	e.listElem = s.lru.PushFront(e)
+	s.entries[key] = e
+
+	if len(s.entries) > c.maxPerShard {
+		if oldest := s.lru.Back(); oldest != nil {
+			s.evict(oldest.Value.(*entry))
+			atomic.AddUint64(&c.evictions, 1)
+		}
+	}
+}
+
+// evict removes e from its shard. Callers must hold s.mu.
+func (s *shard) evict(e *entry) {
+	delete(s.entries, e.key)
+	s.lru.Remove(e.listElem)
+}
+
+// Flush empties the cache; it exists so tests can start from a known
+// state.
+func (c *Cache) Flush() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.entries = make(map[Key]*entry)
+		s.lru = list.New()
+		s.mu.Unlock()
+	}
+}
+
+// Hits, Misses, and Evictions are Prometheus-style monotonic counters,
+// safe to read concurrently. Whoever embeds this cache is responsible for
+// registering them with a /metrics handler.
+func (c *Cache) Hits() uint64      { return atomic.LoadUint64(&c.hits) }
+func (c *Cache) Misses() uint64    { return atomic.LoadUint64(&c.misses) }
+func (c *Cache) Evictions() uint64 { return atomic.LoadUint64(&c.evictions) }
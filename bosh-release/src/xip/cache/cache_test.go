@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetGetExpiry(t *testing.T) {
+	c := New(shardCount * 10)
+	key := Key{Name: "sslip.io.", Qtype: 1, Qclass: 1}
+
+	if _, ok := c.Get(key); ok {
+		t.Fatalf("Get on empty cache: want miss, got hit")
+	}
+	if c.Misses() != 1 {
+		t.Fatalf("Misses() = %d, want 1", c.Misses())
+	}
+
+	want := []byte("a packed response")
+	c.Set(key, want, time.Now().Add(time.Minute))
+
+	got, ok := c.Get(key)
+	if !ok {
+		t.Fatalf("Get after Set: want hit, got miss")
+	}
+	if string(got) != string(want) {
+		t.Fatalf("Get after Set: got %q, want %q", got, want)
+	}
+	if c.Hits() != 1 {
+		t.Fatalf("Hits() = %d, want 1", c.Hits())
+	}
+
+	// the returned slice is a copy; mutating it must not corrupt the cache
+	got[0] = 'X'
+	if got2, _ := c.Get(key); string(got2) != string(want) {
+		t.Fatalf("mutating a Get result corrupted the cached entry: got %q, want %q", got2, want)
+	}
+
+	c.Set(key, want, time.Now().Add(-time.Second))
+	if _, ok := c.Get(key); ok {
+		t.Fatalf("Get on expired entry: want miss, got hit")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	// maxPerShard ends up 1 (shardCount/shardCount); writing four times as
+	// many distinct keys as there are shards forces evictions, regardless of
+	// which shard any individual key happens to hash to
+	c := New(shardCount)
+	const keysPerShard = 4
+	keys := make([]Key, 0, shardCount*keysPerShard)
+	for i := 0; i < shardCount*keysPerShard; i++ {
+		key := Key{Name: string(rune('a'+i%26)) + string(rune(i)) + ".sslip.io.", Qtype: 1, Qclass: 1}
+		keys = append(keys, key)
+		c.Set(key, []byte("x"), time.Now().Add(time.Minute))
+	}
+
+	if c.Evictions() == 0 {
+		t.Fatalf("Evictions() = 0 after writing %d keys into %d shards of capacity 1, want > 0", len(keys), shardCount)
+	}
+
+	// the most recently set key must always survive its own Set
+	last := keys[len(keys)-1]
+	if _, ok := c.Get(last); !ok {
+		t.Fatalf("Get(most recently set key): want hit, got miss")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c := New(shardCount * 10)
+	key := Key{Name: "sslip.io.", Qtype: 1, Qclass: 1}
+	c.Set(key, []byte("a"), time.Now().Add(time.Minute))
+
+	c.Flush()
+
+	if _, ok := c.Get(key); ok {
+		t.Fatalf("Get after Flush: want miss, got hit")
+	}
+}
@@ -0,0 +1,70 @@
+package xip
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// chainOfLength wires up name -> hop1 -> ... -> hopN -> target in CNAMEs,
+// returning every hostname in the chain (name excluded, target included).
+func chainOfLength(t *testing.T, name string, n int) []string {
+	t.Helper()
+	hosts := make([]string, 0, n)
+	current := name
+	for i := 0; i < n; i++ {
+		next := fmt.Sprintf("hop%d.example.com.", i)
+		if i == n-1 {
+			next = "127-0-0-1.sslip.io."
+		}
+		CNAMEs[current] = next
+		hosts = append(hosts, next)
+		current = next
+	}
+	return hosts
+}
+
+func TestResolveCNAMEChainBoundary(t *testing.T) {
+	saved := CNAMEs
+	defer func() { CNAMEs = saved }()
+
+	tests := []struct {
+		name      string
+		chainLen  int
+		wantErr   bool
+		wantChain int
+	}{
+		{"exactly maxCNAMEChain hops resolves", maxCNAMEChain, false, maxCNAMEChain},
+		{"one hop past maxCNAMEChain is SERVFAIL", maxCNAMEChain + 1, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			CNAMEs = map[string]string{}
+			hosts := chainOfLength(t, "start.example.com.", tt.chainLen)
+
+			chain, err := resolveCNAMEChain("start.example.com.")
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveCNAMEChain with %d hops: want SERVFAIL error, got nil", tt.chainLen)
+				}
+				var dnsErr *DNSError
+				if dnsErr, _ = err.(*DNSError); dnsErr == nil || dnsErr.RCode != dnsmessage.RCodeServerFailure {
+					t.Fatalf("resolveCNAMEChain with %d hops: want *DNSError{RCodeServerFailure}, got %v", tt.chainLen, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveCNAMEChain with %d hops: want success, got error %v", tt.chainLen, err)
+			}
+			if len(chain) != tt.wantChain {
+				t.Fatalf("resolveCNAMEChain with %d hops: want chain length %d, got %d (%v)", tt.chainLen, tt.wantChain, len(chain), chain)
+			}
+			if chain[len(chain)-1] != hosts[len(hosts)-1] {
+				t.Fatalf("resolveCNAMEChain with %d hops: want last hop %q, got %q", tt.chainLen, hosts[len(hosts)-1], chain[len(chain)-1])
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package xip
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// buildQuery packs a single-question query, optionally carrying an EDNS0
+// OPT pseudo-RR advertising udpSize as its CLASS field (per RFC 6891).
+func buildQuery(t *testing.T, q dnsmessage.Question, withEDNS0 bool, udpSize uint16) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatalf("StartQuestions: %v", err)
+	}
+	if err := b.Question(q); err != nil {
+		t.Fatalf("Question: %v", err)
+	}
+	if withEDNS0 {
+		if err := b.StartAdditionals(); err != nil {
+			t.Fatalf("StartAdditionals: %v", err)
+		}
+		if err := b.OPTResource(dnsmessage.ResourceHeader{Name: mustName(t, "."), Class: dnsmessage.Class(udpSize)}, dnsmessage.OPTResource{}); err != nil {
+			t.Fatalf("OPTResource: %v", err)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	return msg
+}
+
+func TestEdnsClientUDPSize(t *testing.T) {
+	q := dnsmessage.Question{Name: mustName(t, "sslip.io."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	t.Run("no OPT record", func(t *testing.T) {
+		size, ok, err := ednsClientUDPSize(buildQuery(t, q, false, 0))
+		if err != nil {
+			t.Fatalf("ednsClientUDPSize: %v", err)
+		}
+		if ok {
+			t.Fatalf("ok = true for a query without EDNS0, want false (size %d)", size)
+		}
+	})
+
+	t.Run("OPT record present", func(t *testing.T) {
+		size, ok, err := ednsClientUDPSize(buildQuery(t, q, true, 4096))
+		if err != nil {
+			t.Fatalf("ednsClientUDPSize: %v", err)
+		}
+		if !ok {
+			t.Fatalf("ok = false for a query with EDNS0, want true")
+		}
+		if size != 4096 {
+			t.Fatalf("size = %d, want 4096", size)
+		}
+	})
+}
+
+// TestTruncatedResponseEchoesQuestion guards against the regression where
+// truncatedResponse shipped with no Question section: a resolver that
+// validates the echoed question (RFC 5452 section 9.1) silently discards
+// such a response instead of noticing TC and retrying over TCP.
+func TestTruncatedResponseEchoesQuestion(t *testing.T) {
+	q := dnsmessage.Question{Name: mustName(t, "sslip.io."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	queryHeader := dnsmessage.Header{ID: 1234, RecursionDesired: true}
+
+	responseBytes, err := truncatedResponse(queryHeader, q, false)
+	if err != nil {
+		t.Fatalf("truncatedResponse: %v", err)
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(responseBytes)
+	if err != nil {
+		t.Fatalf("parsing truncatedResponse's output: %v", err)
+	}
+	if !header.Truncated {
+		t.Fatalf("header.Truncated = false, want true")
+	}
+	gotQ, err := p.Question()
+	if err != nil {
+		t.Fatalf("p.Question() on truncatedResponse's output: %v (the Question section is missing or malformed)", err)
+	}
+	if gotQ.Name.String() != q.Name.String() || gotQ.Type != q.Type || gotQ.Class != q.Class {
+		t.Fatalf("echoed question = %+v, want %+v", gotQ, q)
+	}
+}
+
+// TestQueryResponseEdns0SizeClamp exercises the lower end of the clamp
+// around the client-advertised UDP size: an advertised size below
+// defaultUDPSize is bumped up to it, so a normal-sized answer still isn't
+// truncated.
+func TestQueryResponseEdns0SizeClamp(t *testing.T) {
+	q := dnsmessage.Question{Name: mustName(t, "sslip.io."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	responseBytes, logMessage, err := QueryResponse(buildQuery(t, q, true, 16), "udp")
+	if err != nil {
+		t.Fatalf("QueryResponse: %v", err)
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(responseBytes)
+	if err != nil {
+		t.Fatalf("parsing QueryResponse's output: %v", err)
+	}
+	if header.Truncated {
+		t.Fatalf("header.Truncated = true for a normal-sized answer with a tiny advertised EDNS0 size, want false (log: %s)", logMessage)
+	}
+}
@@ -0,0 +1,101 @@
+// Command xip starts the DNS server: it listens on both UDP and TCP port
+// 53, as RFC 1035 requires of an authoritative server, and hands every
+// query off to xip.QueryResponse for the actual lookup.
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"xip"
+)
+
+const dnsPort = 53
+
+func main() {
+	go serveTCP()
+	serveUDP()
+}
+
+// serveUDP answers queries on UDP port 53 for as long as the process runs;
+// an error reading a query is logged and that query is skipped.
+func serveUDP() {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: dnsPort})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to listen on UDP port", dnsPort, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	queryBytes := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFromUDP(queryBytes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading UDP query:", err)
+			continue
+		}
+		responseBytes, logMessage, err := xip.QueryResponse(queryBytes[:n], "udp")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error building response:", err)
+			continue
+		}
+		fmt.Printf("%v.%v: %v\n", addr.IP, addr.Port, logMessage)
+		if _, err = conn.WriteToUDP(responseBytes, addr); err != nil {
+			fmt.Fprintln(os.Stderr, "error writing UDP response:", err)
+		}
+	}
+}
+
+// serveTCP accepts connections on TCP port 53 and answers every query sent
+// on them, one goroutine per connection.
+func serveTCP() {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: dnsPort})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to listen on TCP port", dnsPort, err)
+		os.Exit(1)
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error accepting TCP connection:", err)
+			continue
+		}
+		go handleTCPConn(conn)
+	}
+}
+
+// handleTCPConn answers every query on a TCP connection. Per RFC 1035
+// §4.2.2, each message is prefixed with its length as a 2-byte big-endian
+// integer; unlike UDP, there's no size cap on the response.
+func handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		lengthBytes := make([]byte, 2)
+		if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+			return // client closed the connection, or sent a short message
+		}
+		queryBytes := make([]byte, binary.BigEndian.Uint16(lengthBytes))
+		if _, err := io.ReadFull(conn, queryBytes); err != nil {
+			return
+		}
+
+		responseBytes, logMessage, err := xip.QueryResponse(queryBytes, "tcp")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error building response:", err)
+			return
+		}
+		fmt.Printf("%v: %v\n", conn.RemoteAddr(), logMessage)
+
+		responseLength := make([]byte, 2)
+		binary.BigEndian.PutUint16(responseLength, uint16(len(responseBytes)))
+		if _, err = conn.Write(append(responseLength, responseBytes...)); err != nil {
+			return
+		}
+	}
+}
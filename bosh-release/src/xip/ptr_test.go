@@ -0,0 +1,90 @@
+package xip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// reverseArpaName builds the in-addr.arpa./ip6.arpa. query name for ip,
+// mirroring the unexported reverseaddr() in Go's net package; it's the
+// inverse of arpaToIP, used here to construct round-trip test inputs.
+func reverseArpaName(t *testing.T, ip string) string {
+	t.Helper()
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		t.Fatalf("net.ParseIP(%q) failed", ip)
+	}
+	if ip4 := parsed.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := parsed.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x.%x", ip16[i]&0xf, ip16[i]>>4))
+	}
+	return strings.Join(nibbles, ".") + ".ip6.arpa."
+}
+
+func TestArpaToIPRoundTrip(t *testing.T) {
+	tests := []string{"1.2.3.4", "127.0.0.1", "::1", "2600::1"}
+	for _, want := range tests {
+		t.Run(want, func(t *testing.T) {
+			name := reverseArpaName(t, want)
+			got, err := arpaToIP(name)
+			if err != nil {
+				t.Fatalf("arpaToIP(%q): %v", name, err)
+			}
+			if !got.Equal(net.ParseIP(want)) {
+				t.Fatalf("arpaToIP(%q) = %v, want %v", name, got, want)
+			}
+		})
+	}
+}
+
+func TestArpaToIPNotFound(t *testing.T) {
+	tests := []string{
+		"sslip.io.",               // not under in-addr.arpa. or ip6.arpa. at all
+		"3.2.1.in-addr.arpa.",     // too few labels for an IPv4 address
+		"1.2.3.4.5.in-addr.arpa.", // too many
+	}
+	for _, name := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := arpaToIP(name); err != ErrNotFound {
+				t.Fatalf("arpaToIP(%q) = %v, want ErrNotFound", name, err)
+			}
+		})
+	}
+}
+
+func TestNameToPTR(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		// an address with no well-known name gets the embedded-IP form
+		// (the IPv4 case is the example in NameToPTR's doc comment)
+		{"embedded IPv4, no well-known match", "1.2.3.4", "1-2-3-4.sslip.io."},
+		{"embedded IPv6, no well-known match", "::1", "--1.sslip.io."},
+		// a well-known address resolves back to that name, not the
+		// embedded-IP form
+		{"well-known A record", "78.46.204.247", "sslip.io."},
+		{"well-known nameserver", "52.0.56.137", "ns-aws.nono.io."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arpaName := reverseArpaName(t, tt.ip)
+			ptr, err := NameToPTR(arpaName)
+			if err != nil {
+				t.Fatalf("NameToPTR(%q): %v", arpaName, err)
+			}
+			got := string(ptr.PTR.Data[:ptr.PTR.Length])
+			if got != tt.want {
+				t.Fatalf("NameToPTR(%q) = %q, want %q", arpaName, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package xip
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func mustName(t *testing.T, s string) dnsmessage.Name {
+	t.Helper()
+	name, err := dnsmessage.NewName(s)
+	if err != nil {
+		t.Fatalf("dnsmessage.NewName(%q): %v", s, err)
+	}
+	return name
+}
+
+func TestDetermineRCodeNODATAvsNXDOMAIN(t *testing.T) {
+	tests := []struct {
+		name string
+		q    dnsmessage.Question
+		want dnsmessage.RCode
+	}{
+		{
+			// embeds an IPv4 address, queried as AAAA: the name exists,
+			// it just has no record of the requested type
+			name: "NODATA: embedded IPv4 name queried as AAAA",
+			q:    dnsmessage.Question{Name: mustName(t, "127-0-0-1.sslip.io."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+			want: dnsmessage.RCodeSuccess,
+		},
+		{
+			// embeds an IPv6 address, queried as A
+			name: "NODATA: embedded IPv6 name queried as A",
+			q:    dnsmessage.Question{Name: mustName(t, "--1.sslip.io."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			want: dnsmessage.RCodeSuccess,
+		},
+		{
+			// doesn't parse as any embedded-IP form and isn't a known name
+			name: "NXDOMAIN: unrecognized name",
+			q:    dnsmessage.Question{Name: mustName(t, "nope.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			want: dnsmessage.RCodeNameError,
+		},
+		{
+			name: "Success: embedded IPv4 name queried as A",
+			q:    dnsmessage.Question{Name: mustName(t, "127-0-0-1.sslip.io."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			want: dnsmessage.RCodeSuccess,
+		},
+		{
+			// NameServers only carries an AResource; querying one as AAAA
+			// must still be NODATA, not NXDOMAIN -- the name plainly exists
+			name: "NODATA: NameServers entry (A-only) queried as AAAA",
+			q:    dnsmessage.Question{Name: mustName(t, "ns-aws.nono.io."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+			want: dnsmessage.RCodeSuccess,
+		},
+		{
+			name: "Success: NameServers entry queried as A",
+			q:    dnsmessage.Question{Name: mustName(t, "ns-aws.nono.io."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			want: dnsmessage.RCodeSuccess,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := determineRCode(tt.q); got != tt.want {
+				t.Errorf("determineRCode(%v) = %v, want %v", tt.q.Name, got, tt.want)
+			}
+		})
+	}
+}
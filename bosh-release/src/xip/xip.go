@@ -4,18 +4,40 @@
 package xip
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
 	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
+
+	"xip/cache"
 )
 
 const (
 	Hostmaster = "briancunnie.gmail.com."
 	MxHost     = "mail.protonmail.ch."
+	// maxCacheEntries bounds how many responses responseCache holds; it is
+	// split evenly across the cache's shards, and a full shard evicts its
+	// least-recently-used entry to make room.
+	maxCacheEntries = 100000
+)
+
+// responseCache holds packed responses for single-question, non-EDNS0
+// queries, keyed by (qname, qtype, qclass); see QueryResponse.
+var responseCache = cache.New(maxCacheEntries)
+
+const (
+	// defaultUDPSize is what RFC 1035 guarantees a UDP response can carry
+	// when the client hasn't negotiated anything larger via EDNS0.
+	defaultUDPSize = 512
+	// maxUDPSize is the 2020 DNS flag day recommended UDP payload size;
+	// it's also what Go's stdlib resolver advertises, so we cap at the
+	// same value rather than trusting a larger client-advertised size.
+	maxUDPSize = 1232
 )
 
 var (
@@ -37,9 +59,18 @@ var (
 		"ns-azure.nono.io.": {A: [4]byte{52, 187, 42, 158}},
 		"ns-gce.nono.io.":   {A: [4]byte{104, 155, 144, 4}},
 	}
+	// CNAMEs lets an operator configure vanity hostnames that alias to
+	// another name, e.g. a name that embeds an IP address. Empty by
+	// default; populate it to serve CNAMEs.
+	CNAMEs = map[string]string{}
 )
 
-// DNSError sets the RCode for failed queries, currently only the ANY query
+// maxCNAMEChain caps how many aliases we'll follow to resolve a CNAME
+// before giving up; it also doubles as loop detection for a CNAME cycle.
+const maxCNAMEChain = 8
+
+// DNSError sets the RCode for failed queries, currently only a CNAME chain
+// longer than maxCNAMEChain
 type DNSError struct {
 	RCode dnsmessage.RCode
 }
@@ -50,58 +81,142 @@ func (e *DNSError) Error() string {
 	return fmt.Sprintf("DNS lookup failure, RCode: %v", e.RCode)
 }
 
-// QueryResponse takes in a raw (packed) DNS query and returns a raw (packed)
-// DNS response, a string (for logging) that describes the query and the
-// response, and an error. It takes in the raw data to offload as much as
-// possible from main(). main() is hard to unit test, but functions like
-// QueryResponse are not as hard.
+// QueryResponse takes in a raw (packed) DNS query and the protocol it
+// arrived on ("udp" or "tcp"), and returns a raw (packed) DNS response, a
+// string (for logging) that describes the query and the response, and an
+// error. It takes in the raw data to offload as much as possible from
+// main(). main() is hard to unit test, but functions like QueryResponse are
+// not as hard.
+//
+// protocol matters because UDP responses are capped to the size the client
+// advertised via EDNS0, clamped to between defaultUDPSize and maxUDPSize
+// (or 512 bytes, absent EDNS0); when the answer doesn't
+// fit, we set the TC (truncated) bit and drop the answer so the client
+// retries over TCP, which has no such cap.
 //
 // Examples of log strings returned:
-//   78.46.204.247.33654: TypeA 127-0-0-1.sslip.io ? 127.0.0.1
-//   78.46.204.247.33654: TypeA www.sslip.io ? nil, SOA
-//   78.46.204.247.33654: TypeNS www.example.com ? NS
-//   78.46.204.247.33654: TypeSOA www.example.com ? SOA
-//   2600::.33654: TypeAAAA --1.sslip.io ? ::1
-func QueryResponse(queryBytes []byte) (responseBytes []byte, logMessage string, err error) {
+//
+//	TypeA 127-0-0-1.sslip.io. ? 127.0.0.1
+//	TypeA www.sslip.io. ? nil, SOA
+//	TypeNS www.example.com. ? NS
+//	TypeSOA www.example.com. ? SOA
+//	TypeAAAA --1.sslip.io. ? ::1
+func QueryResponse(queryBytes []byte, protocol string) (responseBytes []byte, logMessage string, err error) {
 	var queryHeader dnsmessage.Header
-	var response []byte
 	var p dnsmessage.Parser
 
 	if queryHeader, err = p.Start(queryBytes); err != nil {
 		return
 	}
 
-	b := dnsmessage.NewBuilder(response, ResponseHeader(queryHeader, dnsmessage.RCodeSuccess))
+	// RFC 9619 recommends refusing queries with more than one question,
+	// which is what most authoritative servers do today; it also settles
+	// what was previously an ambiguity here, since only one question's
+	// outcome could ever drive the response's RCODE anyway
+	q, qErr := p.Question()
+	if qErr != nil {
+		responseBytes, err = refusedResponse(queryHeader, dnsmessage.RCodeFormatError, nil)
+		logMessage = "malformed or missing question, FORMERR"
+		return
+	}
+	if _, extraErr := p.Question(); extraErr != dnsmessage.ErrSectionDone {
+		responseBytes, err = refusedResponse(queryHeader, dnsmessage.RCodeFormatError, &q)
+		logMessage = "more than one question, FORMERR"
+		return
+	}
+
+	// a malformed OPT record shouldn't take down the whole query; we just
+	// fall back to assuming the client didn't offer EDNS0
+	clientUDPSize, hasEDNS0, ednsErr := ednsClientUDPSize(queryBytes)
+	if ednsErr != nil {
+		hasEDNS0 = false
+	}
+
+	// caching is limited to the common case of a non-EDNS0 query: an
+	// EDNS0 response carries an OPT record we'd otherwise have to strip
+	// and rebuild per cache hit, which isn't worth the complexity here
+	cacheable := !hasEDNS0
+	cacheKey := cache.Key{Name: strings.ToLower(q.Name.String()), Qtype: uint16(q.Type), Qclass: uint16(q.Class)}
+	if cacheable {
+		if cached, ok := responseCache.Get(cacheKey); ok {
+			binary.BigEndian.PutUint16(cached[0:2], queryHeader.ID)
+			responseBytes = cached
+			logMessage = q.Type.String() + " " + q.Name.String() + " ? (cached)"
+		}
+	}
+
+	if responseBytes == nil {
+		if responseBytes, logMessage, err = buildResponse(queryHeader, q, hasEDNS0); err != nil {
+			return
+		}
+		if cacheable {
+			if expiresAt, ok := responseExpiry(responseBytes); ok {
+				responseCache.Set(cacheKey, responseBytes, expiresAt)
+			}
+		}
+	}
+
+	if protocol == "udp" {
+		maxSize := uint16(defaultUDPSize)
+		if hasEDNS0 {
+			maxSize = clientUDPSize
+			if maxSize < defaultUDPSize {
+				maxSize = defaultUDPSize
+			}
+			if maxSize > maxUDPSize {
+				maxSize = maxUDPSize
+			}
+		}
+		if len(responseBytes) > int(maxSize) {
+			if responseBytes, err = truncatedResponse(queryHeader, q, hasEDNS0); err != nil {
+				return
+			}
+			logMessage += ", truncated"
+		}
+	}
+	return
+}
+
+// buildResponse assembles the full (untruncated) response to q: its
+// answers and authorities, plus an OPT pseudo-RR echoing our own maximum
+// UDP payload size when the query included one.
+//
+// The response's RCODE is decided up front by determineRCode, before the
+// dnsmessage.Builder (whose header, RCODE included, can't change once
+// construction starts) is even created.
+func buildResponse(queryHeader dnsmessage.Header, q dnsmessage.Question, hasEDNS0 bool) (responseBytes []byte, logMessage string, err error) {
+	rcode := determineRCode(q)
+
+	var response []byte
+	b := dnsmessage.NewBuilder(response, ResponseHeader(queryHeader, rcode))
 	b.EnableCompression()
 	if err = b.StartQuestions(); err != nil {
 		return
 	}
-	for {
-		var q dnsmessage.Question
-		q, err = p.Question()
-		if err == dnsmessage.ErrSectionDone {
-			break
+	if err = b.Question(q); err != nil {
+		return
+	}
+
+	if rcode == dnsmessage.RCodeNotImplemented {
+		// we don't implement type ANY, so return "NotImplemented" like
+		// CloudFlare (1.1.1.1); see https://blog.cloudflare.com/rfc8482-saying-goodbye-to-any/
+		logMessage = q.Type.String() + " " + q.Name.String() + " ? not implemented"
+	} else {
+		if logMessage, err = processQuestion(q, &b); err != nil {
+			return
 		}
-		if err != nil {
+	}
+
+	if hasEDNS0 {
+		if err = b.StartAdditionals(); err != nil {
 			return
 		}
-		if err = b.Question(q); err != nil {
+		var optHeader dnsmessage.ResourceHeader
+		if optHeader, err = optResourceHeader(); err != nil {
 			return
 		}
-		logMessage, err = processQuestion(q, &b)
-		if err != nil {
-			if e, ok := err.(*DNSError); ok {
-				// set RCODE to
-				queryHeader.RCode = e.RCode
-				b = dnsmessage.NewBuilder(response, ResponseHeader(queryHeader, dnsmessage.RCodeNotImplemented))
-				b.EnableCompression()
-				break
-			} else {
-				// processQuestion shouldn't return any error but {nil,DNSError},
-				// but who knows? Someone might break contract. This is the guard.
-				err = errors.New("processQuestion() returned unexpected error type")
-				return
-			}
+		if err = b.OPTResource(optHeader, dnsmessage.OPTResource{}); err != nil {
+			return
 		}
 	}
 
@@ -113,13 +228,248 @@ func QueryResponse(queryBytes []byte) (responseBytes []byte, logMessage string,
 	return
 }
 
+// optResourceHeader builds the ResourceHeader for the OPT pseudo-RR we
+// echo back to advertise our own max UDP payload size: per RFC 6891 its
+// owner name must be the root domain.
+func optResourceHeader() (dnsmessage.ResourceHeader, error) {
+	root, err := packName(".")
+	if err != nil {
+		return dnsmessage.ResourceHeader{}, err
+	}
+	return dnsmessage.ResourceHeader{Name: root, Class: dnsmessage.Class(maxUDPSize)}, nil
+}
+
+// refusedResponse builds a response with the given RCode and no further
+// sections, used when we refuse to process the query at all. q is echoed
+// back in the Question section when available (a resolver following RFC
+// 5452 §9.1's anti-spoofing advice validates the echoed question against
+// the one it sent, and silently discards a response that omits it); it's
+// nil when the query itself didn't parse, so there's nothing to echo.
+func refusedResponse(queryHeader dnsmessage.Header, rcode dnsmessage.RCode, q *dnsmessage.Question) (responseBytes []byte, err error) {
+	var response []byte
+	b := dnsmessage.NewBuilder(response, ResponseHeader(queryHeader, rcode))
+	if q != nil {
+		if err = b.StartQuestions(); err != nil {
+			return
+		}
+		if err = b.Question(*q); err != nil {
+			return
+		}
+	}
+	return b.Finish()
+}
+
+// determineRCode decides the RCODE of the response to q:
+//   - TypeALL: NotImplemented, since we don't serve ANY queries
+//   - TypeA/TypeAAAA that resolve (directly, or via a CNAME chain):
+//     Success
+//   - TypeA/TypeAAAA that don't, but whose name parses as the *other*
+//     embedded-IP form: Success, since the name exists but has no record
+//     of the queried type (NODATA), which is what stops a stub resolver
+//     from re-asking (see the fix in Go's CL 133675)
+//   - TypeA/TypeAAAA that don't parse as either embedded-IP form and
+//     aren't one of our well-known names: NameError (NXDOMAIN)
+//   - a CNAME chain longer than maxCNAMEChain: ServerFailure
+//   - everything else: Success
+func determineRCode(q dnsmessage.Question) dnsmessage.RCode {
+	switch q.Type {
+	case dnsmessage.TypeALL:
+		return dnsmessage.RCodeNotImplemented
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		name := q.Name.String()
+		chain, chainErr := resolveCNAMEChain(name)
+		if chainErr != nil {
+			return dnsmessage.RCodeServerFailure
+		}
+		if len(chain) > 0 {
+			name = chain[len(chain)-1]
+		}
+		var foundErr error
+		if q.Type == dnsmessage.TypeA {
+			_, foundErr = NameToA(name)
+		} else {
+			_, foundErr = NameToAAAA(name)
+		}
+		if foundErr == nil {
+			return dnsmessage.RCodeSuccess
+		}
+		otherRE := ipv6RE
+		if q.Type == dnsmessage.TypeAAAA {
+			otherRE = ipv4RE
+		}
+		if otherRE.MatchString(name) {
+			return dnsmessage.RCodeSuccess
+		}
+		// the name exists -- it's one of our well-known records -- it
+		// just doesn't have one of its own for the queried type (e.g. a
+		// NameServers entry, which is A-only): NODATA, not NXDOMAIN
+		if _, ok := OurAandAAAARecords[name]; ok {
+			return dnsmessage.RCodeSuccess
+		}
+		if _, ok := NameServers[name]; ok {
+			return dnsmessage.RCodeSuccess
+		}
+		return dnsmessage.RCodeNameError
+	default:
+		return dnsmessage.RCodeSuccess
+	}
+}
+
+// truncatedResponse builds the minimal response sent when the full answer
+// doesn't fit in the client's UDP budget: question echoed back, TC set, no
+// answers, so the client knows to retry the same query over TCP. The
+// Question section has to be there: a resolver that validates the echoed
+// question (RFC 5452 §9.1) silently discards a response that omits it.
+func truncatedResponse(queryHeader dnsmessage.Header, q dnsmessage.Question, hasEDNS0 bool) (responseBytes []byte, err error) {
+	header := ResponseHeader(queryHeader, dnsmessage.RCodeSuccess)
+	header.Truncated = true
+	var response []byte
+	b := dnsmessage.NewBuilder(response, header)
+	if err = b.StartQuestions(); err != nil {
+		return
+	}
+	if err = b.Question(q); err != nil {
+		return
+	}
+	if hasEDNS0 {
+		if err = b.StartAdditionals(); err != nil {
+			return
+		}
+		var optHeader dnsmessage.ResourceHeader
+		if optHeader, err = optResourceHeader(); err != nil {
+			return
+		}
+		if err = b.OPTResource(optHeader, dnsmessage.OPTResource{}); err != nil {
+			return
+		}
+	}
+	return b.Finish()
+}
+
+// ednsClientUDPSize scans a query's Additional section for an EDNS0 OPT
+// pseudo-RR and returns the UDP payload size the client advertised. ok is
+// false if the client didn't send one, in which case size is meaningless
+// and callers should fall back to the RFC 1035 default of 512.
+func ednsClientUDPSize(queryBytes []byte) (size uint16, ok bool, err error) {
+	var p dnsmessage.Parser
+	if _, err = p.Start(queryBytes); err != nil {
+		return
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return
+	}
+	if err = p.SkipAllAnswers(); err != nil {
+		return
+	}
+	if err = p.SkipAllAuthorities(); err != nil {
+		return
+	}
+	for {
+		var h dnsmessage.ResourceHeader
+		h, err = p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if h.Type != dnsmessage.TypeOPT {
+			if err = p.SkipAdditional(); err != nil {
+				return
+			}
+			continue
+		}
+		if _, err = p.OPTResource(); err != nil {
+			return
+		}
+		size, ok = uint16(h.Class), true
+		return
+	}
+}
+
+// responseExpiry determines when a built response should fall out of the
+// cache: the lowest TTL among its answers for a positive response, or the
+// SOA's MinTTL (per RFC 2308's negative-caching rule) for NXDOMAIN/NODATA.
+// ok is false for anything else, e.g. a REFUSED/SERVFAIL we'd rather not
+// cache at all.
+func responseExpiry(responseBytes []byte) (expiresAt time.Time, ok bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(responseBytes)
+	if err != nil {
+		return
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	var minTTL uint32
+	haveAnswer := false
+	for {
+		var h dnsmessage.ResourceHeader
+		h, err = p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return time.Time{}, false
+		}
+		if !haveAnswer || h.TTL < minTTL {
+			minTTL = h.TTL
+		}
+		haveAnswer = true
+		if err = p.SkipAnswer(); err != nil {
+			return time.Time{}, false
+		}
+	}
+	if haveAnswer {
+		return time.Now().Add(time.Duration(minTTL) * time.Second), true
+	}
+
+	if header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+		return time.Time{}, false
+	}
+	for {
+		var h dnsmessage.ResourceHeader
+		h, err = p.AuthorityHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return time.Time{}, false
+		}
+		if err != nil {
+			return time.Time{}, false
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err = p.SkipAuthority(); err != nil {
+				return time.Time{}, false
+			}
+			continue
+		}
+		var soa dnsmessage.SOAResource
+		if soa, err = p.SOAResource(); err != nil {
+			return time.Time{}, false
+		}
+		return time.Now().Add(time.Duration(soa.MinTTL) * time.Second), true
+	}
+}
+
 func processQuestion(q dnsmessage.Question, b *dnsmessage.Builder) (logMessage string, err error) {
 	logMessage = q.Type.String() + " " + q.Name.String() + " ? "
 	switch q.Type {
 	case dnsmessage.TypeA:
 		{
+			chain, chainErr := resolveCNAMEChain(q.Name.String())
+			if chainErr != nil {
+				// determineRCode already set the response's RCODE to
+				// ServerFailure for this; there's nothing more to write
+				logMessage += "CNAME chain too long, SERVFAIL"
+				return
+			}
+			targetName := q.Name.String()
+			if len(chain) > 0 {
+				targetName = chain[len(chain)-1]
+			}
 			var nameToA *dnsmessage.AResource
-			nameToA, err = NameToA(q.Name.String())
+			nameToA, err = NameToA(targetName)
 			if err != nil {
 				// There's only one possible error this can be: ErrNotFound. note that
 				// this could be written more efficiently; however, I wrote it to
@@ -145,8 +495,17 @@ func processQuestion(q dnsmessage.Question, b *dnsmessage.Builder) (logMessage s
 				if err != nil {
 					return
 				}
+				owner := q.Name
+				if len(chain) > 0 {
+					if err = appendCNAMEChain(b, q.Name, chain); err != nil {
+						return
+					}
+					if owner, err = packName(targetName); err != nil {
+						return
+					}
+				}
 				err = b.AResource(dnsmessage.ResourceHeader{
-					Name:   q.Name,
+					Name:   owner,
 					Type:   dnsmessage.TypeSOA,
 					Class:  dnsmessage.ClassINET,
 					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
@@ -156,13 +515,28 @@ func processQuestion(q dnsmessage.Question, b *dnsmessage.Builder) (logMessage s
 					return
 				}
 				ip := net.IP(nameToA.A[:])
-				logMessage += ip.String()
+				if len(chain) > 0 {
+					logMessage += strings.Join(chain, " -> ") + " -> " + ip.String()
+				} else {
+					logMessage += ip.String()
+				}
 			}
 		}
 	case dnsmessage.TypeAAAA:
 		{
+			chain, chainErr := resolveCNAMEChain(q.Name.String())
+			if chainErr != nil {
+				// determineRCode already set the response's RCODE to
+				// ServerFailure for this; there's nothing more to write
+				logMessage += "CNAME chain too long, SERVFAIL"
+				return
+			}
+			targetName := q.Name.String()
+			if len(chain) > 0 {
+				targetName = chain[len(chain)-1]
+			}
 			var nameToAAAA *dnsmessage.AAAAResource
-			nameToAAAA, err = NameToAAAA(q.Name.String())
+			nameToAAAA, err = NameToAAAA(targetName)
 			if err != nil {
 				// There's only one possible error this can be: ErrNotFound. note that
 				// this could be written more efficiently; however, I wrote it to
@@ -188,8 +562,17 @@ func processQuestion(q dnsmessage.Question, b *dnsmessage.Builder) (logMessage s
 				if err != nil {
 					return
 				}
+				owner := q.Name
+				if len(chain) > 0 {
+					if err = appendCNAMEChain(b, q.Name, chain); err != nil {
+						return
+					}
+					if owner, err = packName(targetName); err != nil {
+						return
+					}
+				}
 				err = b.AAAAResource(dnsmessage.ResourceHeader{
-					Name:   q.Name,
+					Name:   owner,
 					Type:   dnsmessage.TypeAAAA,
 					Class:  dnsmessage.ClassINET,
 					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
@@ -199,16 +582,91 @@ func processQuestion(q dnsmessage.Question, b *dnsmessage.Builder) (logMessage s
 					return
 				}
 				ip := net.IP(nameToAAAA.AAAA[:])
-				logMessage += ip.String()
+				if len(chain) > 0 {
+					logMessage += strings.Join(chain, " -> ") + " -> " + ip.String()
+				} else {
+					logMessage += ip.String()
+				}
 			}
 		}
-	case dnsmessage.TypeALL:
+	case dnsmessage.TypeCNAME:
 		{
-			// We don't implement type ANY, so return "NotImplemented" like CloudFlare (1.1.1.1)
-			// https://blog.cloudflare.com/rfc8482-saying-goodbye-to-any/
-			// Google (8.8.8.8) returns every record they can find (A, AAAA, SOA, NS, MX, ...).
-			err = &DNSError{RCode: dnsmessage.RCodeNotImplemented}
-			return
+			target, ok := CNAMEs[q.Name.String()]
+			if !ok {
+				err = b.StartAuthorities()
+				if err != nil {
+					return
+				}
+				err = b.SOAResource(dnsmessage.ResourceHeader{
+					Name:   q.Name,
+					Type:   dnsmessage.TypeSOA,
+					Class:  dnsmessage.ClassINET,
+					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; it's not gonna change
+					Length: 0,
+				}, SOAResource(q.Name.String()))
+				if err != nil {
+					return
+				}
+				logMessage += "nil, SOA"
+			} else {
+				err = b.StartAnswers()
+				if err != nil {
+					return
+				}
+				var cname dnsmessage.CNAMEResource
+				if cname, err = cnameResource(target); err != nil {
+					return
+				}
+				err = b.CNAMEResource(dnsmessage.ResourceHeader{
+					Name:   q.Name,
+					Type:   dnsmessage.TypeCNAME,
+					Class:  dnsmessage.ClassINET,
+					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+					Length: 0,
+				}, cname)
+				if err != nil {
+					return
+				}
+				logMessage += target
+			}
+		}
+	case dnsmessage.TypePTR:
+		{
+			var nameToPTR *dnsmessage.PTRResource
+			nameToPTR, err = NameToPTR(q.Name.String())
+			if err != nil {
+				err = b.StartAuthorities()
+				if err != nil {
+					return
+				}
+				err = b.SOAResource(dnsmessage.ResourceHeader{
+					Name:   q.Name,
+					Type:   dnsmessage.TypeSOA,
+					Class:  dnsmessage.ClassINET,
+					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; it's not gonna change
+					Length: 0,
+				}, SOAResource(q.Name.String()))
+				if err != nil {
+					return
+				}
+				logMessage += "nil, SOA"
+			} else {
+				err = b.StartAnswers()
+				if err != nil {
+					return
+				}
+				err = b.PTRResource(dnsmessage.ResourceHeader{
+					Name:   q.Name,
+					Type:   dnsmessage.TypePTR,
+					Class:  dnsmessage.ClassINET,
+					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+					Length: 0,
+				}, *nameToPTR)
+				if err != nil {
+					return
+				}
+				logMessage += nameToPTR.PTR.String()
+			}
 		}
 	case dnsmessage.TypeMX:
 		{
@@ -352,6 +810,164 @@ func NameToAAAA(fqdnString string) (*dnsmessage.AAAAResource, error) {
 	return &AAAAR, nil
 }
 
+// resolveCNAMEChain follows name through CNAMEs until it reaches a target
+// that isn't itself an alias, returning every hop visited along the way
+// (the final, non-alias target last). name itself isn't included. An empty
+// chain with a nil error means name isn't a CNAME at all.
+func resolveCNAMEChain(name string) (chain []string, err error) {
+	current := name
+	// maxCNAMEChain+1 lookups: the extra one lets a chain of exactly
+	// maxCNAMEChain hops reach its terminal, non-alias target before we
+	// give up, instead of always spending the last hop's budget on the
+	// lookup that proves termination.
+	for i := 0; i < maxCNAMEChain+1; i++ {
+		target, ok := CNAMEs[current]
+		if !ok {
+			return chain, nil
+		}
+		chain = append(chain, target)
+		current = target
+	}
+	return nil, &DNSError{RCode: dnsmessage.RCodeServerFailure}
+}
+
+// appendCNAMEChain writes one CNAME answer per hop in chain: the first is
+// owned by name, and each subsequent one by the previous hop's target.
+func appendCNAMEChain(b *dnsmessage.Builder, name dnsmessage.Name, chain []string) (err error) {
+	owner := name
+	for _, target := range chain {
+		var cname dnsmessage.CNAMEResource
+		if cname, err = cnameResource(target); err != nil {
+			return
+		}
+		if err = b.CNAMEResource(dnsmessage.ResourceHeader{
+			Name:   owner,
+			Type:   dnsmessage.TypeCNAME,
+			Class:  dnsmessage.ClassINET,
+			TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; it's not gonna change
+			Length: 0,
+		}, cname); err != nil {
+			return
+		}
+		if owner, err = packName(target); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// packName wraps s as a dnsmessage.Name, the fixed-size-array encoding
+// dnsmessage.Builder and its resource types expect.
+func packName(s string) (dnsmessage.Name, error) {
+	if len(s) > 255 {
+		return dnsmessage.Name{}, ErrNotFound
+	}
+	var data [255]byte
+	copy(data[:], s)
+	return dnsmessage.Name{Data: data, Length: uint8(len(s))}, nil
+}
+
+// cnameResource wraps target up as a CNAMEResource.
+func cnameResource(target string) (dnsmessage.CNAMEResource, error) {
+	name, err := packName(target)
+	if err != nil {
+		return dnsmessage.CNAMEResource{}, err
+	}
+	return dnsmessage.CNAMEResource{CNAME: name}, nil
+}
+
+// NameToPTR returns either a PTRResource that answers a reverse lookup
+// under in-addr.arpa. or ip6.arpa. or ErrNotFound. Addresses that belong to
+// one of our well-known names (OurAandAAAARecords, NameServers) resolve
+// back to that name; every other address gets the canonical sslip.io
+// hostname that embeds it, e.g. 4.3.2.1.in-addr.arpa. -> 1-2-3-4.sslip.io.
+func NameToPTR(fqdnString string) (*dnsmessage.PTRResource, error) {
+	ip, err := arpaToIP(fqdnString)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	for name, records := range OurAandAAAARecords {
+		if net.IP(records.AResource.A[:]).Equal(ip) || net.IP(records.AAAAResource.AAAA[:]).Equal(ip) {
+			return ptrResource(name)
+		}
+	}
+	for name, nsAResource := range NameServers {
+		if net.IP(nsAResource.A[:]).Equal(ip) {
+			return ptrResource(name)
+		}
+	}
+	return ptrResource(ipToName(ip))
+}
+
+// arpaToIP parses a reverse-lookup query name under in-addr.arpa. or
+// ip6.arpa. back into the IP address it encodes; it's the inverse of the
+// unexported reverseaddr() in Go's net package.
+func arpaToIP(fqdnString string) (net.IP, error) {
+	name := strings.TrimSuffix(fqdnString, ".")
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil, ErrNotFound
+		}
+		reverseStrings(labels)
+		ip := net.ParseIP(strings.Join(labels, ".")).To4()
+		if ip == nil {
+			return nil, ErrNotFound
+		}
+		return ip, nil
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil, ErrNotFound
+		}
+		reverseStrings(nibbles)
+		var groups []string
+		for i := 0; i < len(nibbles); i += 4 {
+			groups = append(groups, strings.Join(nibbles[i:i+4], ""))
+		}
+		ip := net.ParseIP(strings.Join(groups, ":")).To16()
+		if ip == nil {
+			return nil, ErrNotFound
+		}
+		return ip, nil
+	default:
+		return nil, ErrNotFound
+	}
+}
+
+// reverseStrings reverses s in place.
+func reverseStrings(s []string) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+// ipToName synthesizes the canonical sslip.io hostname that embeds ip, the
+// same form NameToA/NameToAAAA parse back into an address.
+func ipToName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.ReplaceAll(ip4.String(), ".", "-") + ".sslip.io."
+	}
+	return strings.ReplaceAll(ip.String(), ":", "-") + ".sslip.io."
+}
+
+// ptrResource wraps name up as a PTRResource, matching the pattern used by
+// NSResources()/MXResource() to stuff a dnsmessage.Name's fixed-size array.
+func ptrResource(name string) (*dnsmessage.PTRResource, error) {
+	if len(name) > 255 {
+		return nil, ErrNotFound
+	}
+	var nameBytes [255]byte
+	copy(nameBytes[:], name)
+	return &dnsmessage.PTRResource{
+		PTR: dnsmessage.Name{
+			Data:   nameBytes,
+			Length: uint8(len(name)),
+		},
+	}, nil
+}
+
 func NSResources() map[string]dnsmessage.NSResource {
 	nsResources := make(map[string]dnsmessage.NSResource)
 	for nameServer, _ := range NameServers {
@@ -401,4 +1017,4 @@ func SOAResource(domain string) dnsmessage.SOAResource {
 		Expire:  1800,
 		MinTTL:  300,
 	}
-}
\ No newline at end of file
+}